@@ -0,0 +1,360 @@
+package popularpost
+
+import (
+	"fmt"
+	"socialapi/models"
+	"time"
+
+	"github.com/koding/redis"
+	"github.com/streadway/amqp"
+	"golang.org/x/net/context"
+)
+
+const (
+	// DefaultFlushInterval is how long runBatch waits for more interactions
+	// before flushing a partial batch.
+	DefaultFlushInterval = 250 * time.Millisecond
+
+	// DefaultMaxBatch caps how many interactions are coalesced into a single
+	// flush, regardless of how quickly they arrive.
+	DefaultMaxBatch = 500
+)
+
+// pendingInteraction pairs an interaction with the amqp delivery that
+// produced it, so the delivery can be acked/nacked once the batch it
+// belongs to has been flushed.
+type pendingInteraction struct {
+	incrementCount int
+	interaction    *models.Interaction
+	delivery       amqp.Delivery
+}
+
+// incrByKey identifies a single sorted set member whose score should be
+// bumped - the (bucket key, message id) pair that a ZINCRBY targets. group
+// and channelName are carried along so the write can be routed to the
+// right shard.
+type incrByKey struct {
+	key         string
+	member      int64
+	group       string
+	channelName string
+}
+
+// EnqueueInteraction queues an interaction for batched processing instead of
+// writing it to Redis synchronously. The delivery is not acked until the
+// batch containing it has been flushed; callers should not ack/nack it
+// themselves.
+func (f *Controller) EnqueueInteraction(incrementCount int, i *models.Interaction, delivery amqp.Delivery) {
+	f.batch <- &pendingInteraction{
+		incrementCount: incrementCount,
+		interaction:    i,
+		delivery:       delivery,
+	}
+}
+
+// StartBatchFlusher launches the background flusher that coalesces queued
+// interactions and writes them to Redis in merged batches. It blocks until
+// ctx is done.
+func (f *Controller) StartBatchFlusher(ctx context.Context, flushInterval time.Duration, maxBatch int) {
+	f.runBatch(ctx, flushInterval, maxBatch)
+}
+
+// runBatch accumulates interactions arriving on f.batch and flushes them
+// either when maxBatch is reached or flushInterval elapses, whichever comes
+// first.
+func (f *Controller) runBatch(ctx context.Context, flushInterval time.Duration, maxBatch int) {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	pending := make([]*pendingInteraction, 0, maxBatch)
+	var opened time.Time
+
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+
+		batch := pending
+		pending = make([]*pendingInteraction, 0, maxBatch)
+
+		if err := f.flushBatch(batch); err != nil {
+			f.log.Error(fmt.Sprintf("flushing popular post batch of %d failed: %s", len(batch), err))
+		}
+
+		f.metrics.observeFlush(len(batch), time.Since(opened))
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			flush()
+			return
+		case p := <-f.batch:
+			if len(pending) == 0 {
+				opened = time.Now()
+			}
+			pending = append(pending, p)
+			if len(pending) >= maxBatch {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// messageGroup collects every pendingInteraction in a flush that targets
+// the same ChannelMessage, so the rate limiter (which operates on a single
+// merged count per message) sees one combined increment per flush instead
+// of one call per interaction.
+type messageGroup struct {
+	c         *models.Channel
+	cm        *models.ChannelMessage
+	increment int
+	owners    []*pendingInteraction
+}
+
+// flushBatch resolves the ChannelMessage/Channel for every interaction in
+// the batch with a single ChannelMessagesByIds query, merges duplicate
+// increments targeting the same sorted set member, applies f.limiter (if
+// configured) once per message, writes whichever extra ranking algorithm is
+// configured via writeRankingBucket, and writes the legacy daily/7-day
+// buckets to Redis over one pipeline per shard. Each delivery is acked on success or
+// handed to DefaultErrHandler on failure.
+func (f *Controller) flushBatch(pending []*pendingInteraction) error {
+	messageIds := make([]int64, 0, len(pending))
+	seen := make(map[int64]bool, len(pending))
+	for _, p := range pending {
+		if seen[p.interaction.MessageId] {
+			continue
+		}
+		seen[p.interaction.MessageId] = true
+		messageIds = append(messageIds, p.interaction.MessageId)
+	}
+
+	messages, err := models.ChannelMessagesByIds(messageIds...)
+	if err != nil {
+		f.nackAll(pending, err)
+		return err
+	}
+
+	messagesById := make(map[int64]*models.ChannelMessage, len(messages))
+	for _, cm := range messages {
+		messagesById[cm.Id] = cm
+	}
+
+	channelsById := make(map[int64]*models.Channel)
+	groups := make(map[int64]*messageGroup)
+	groupOrder := make([]int64, 0, len(messageIds))
+
+	for _, p := range pending {
+		cm, ok := messagesById[p.interaction.MessageId]
+		if !ok {
+			f.nack(p, fmt.Errorf("no channel message found for interaction %d", p.interaction.Id))
+			continue
+		}
+
+		c, ok := channelsById[cm.InitialChannelId]
+		if !ok {
+			c, err = models.ChannelById(cm.InitialChannelId)
+			if err != nil {
+				f.nack(p, err)
+				continue
+			}
+			channelsById[cm.InitialChannelId] = c
+		}
+
+		if notEligibleForPopularPost(c, cm) || createdMoreThan7DaysAgo(cm.CreatedAt) {
+			f.ack(p)
+			continue
+		}
+
+		g, ok := groups[cm.Id]
+		if !ok {
+			g = &messageGroup{c: c, cm: cm}
+			groups[cm.Id] = g
+			groupOrder = append(groupOrder, cm.Id)
+		}
+		g.increment += p.incrementCount
+		g.owners = append(g.owners, p)
+	}
+
+	deltas := make(map[incrByKey]int)
+	owners := make(map[incrByKey][]*pendingInteraction)
+	ttls := make(map[string]time.Duration)
+	limited := make(map[int64]int) // messageId -> delta owed to the limiter on write failure
+
+	for _, messageId := range groupOrder {
+		g := groups[messageId]
+		c, cm := g.c, g.cm
+
+		increment := g.increment
+		if f.limiter != nil {
+			delta, ok := f.limiter.allow(c.GroupName, c.Name, c.TypeConstant, cm.Id, increment)
+			if !ok {
+				for _, p := range g.owners {
+					f.ack(p)
+				}
+				continue
+			}
+			increment = delta
+			limited[messageId] = delta
+		}
+
+		sevenDay := GetSevenDayKey(c, cm)
+		if !f.shardFor(c.GroupName, c.Name).Exists(sevenDay) {
+			if err := f.createSevenDayCombinedBucket(c, cm, sevenDay, getStartOfDay(cm.CreatedAt)); err != nil {
+				f.refundLimiter(c, cm, limited)
+				f.nackAll(g.owners, err)
+				continue
+			}
+		}
+
+		if err := f.writeRankingBucket(c, cm, g.owners[0].interaction, increment); err != nil {
+			f.refundLimiter(c, cm, limited)
+			f.nackAll(g.owners, err)
+			continue
+		}
+
+		daily := GetDailyKey(c, cm.CreatedAt)
+		ttls[daily] = dailyKeyTTL(cm.CreatedAt)
+		ttls[sevenDay] = sevenDayKeyTTL(cm.CreatedAt)
+
+		for _, k := range []incrByKey{
+			{key: daily, member: cm.Id, group: c.GroupName, channelName: c.Name},
+			{key: sevenDay, member: cm.Id, group: c.GroupName, channelName: c.Name},
+		} {
+			deltas[k] += increment
+			owners[k] = append(owners[k], g.owners...)
+		}
+	}
+
+	if err := f.pipelineIncrBy(deltas); err != nil {
+		for messageId, delta := range limited {
+			g := groups[messageId]
+			f.limiter.refund(g.c.GroupName, g.c.Name, g.cm.Id, delta)
+		}
+		for _, ps := range owners {
+			f.nackAll(ps, err)
+		}
+		return err
+	}
+
+	for k := range deltas {
+		f.expire(k.group, k.channelName, k.key, ttls[k.key])
+	}
+
+	acked := make(map[*pendingInteraction]bool, len(pending))
+	for _, ps := range owners {
+		for _, p := range ps {
+			if acked[p] {
+				continue
+			}
+			acked[p] = true
+			f.ack(p)
+		}
+	}
+
+	return nil
+}
+
+// refundLimiter returns a message's coalesced delta to the limiter when a
+// write fails before reaching the pipeline, so it isn't lost.
+func (f *Controller) refundLimiter(c *models.Channel, cm *models.ChannelMessage, limited map[int64]int) {
+	delta, ok := limited[cm.Id]
+	if !ok {
+		return
+	}
+	delete(limited, cm.Id)
+	f.limiter.refund(c.GroupName, c.Name, cm.Id, delta)
+}
+
+// pipelineIncrBy issues one ZINCRBY per distinct (key, member) pair, grouped
+// into one pipeline per shard, so a batch touching N members costs one
+// round trip per shard instead of N round trips total. While a shard
+// migration is in progress, the same deltas are also written to the
+// migration target's shards.
+func (f *Controller) pipelineIncrBy(deltas map[incrByKey]int) error {
+	if len(deltas) == 0 {
+		return nil
+	}
+
+	byShard := f.groupDeltasByShard(deltas)
+
+	for r, shardDeltas := range byShard {
+		if err := pipelineIncrByOnSession(r, shardDeltas); err != nil {
+			return err
+		}
+	}
+
+	if f.shards != nil && f.shards.migration != nil {
+		byTarget := make(map[*redis.RedisSession]map[incrByKey]int)
+		for k, delta := range deltas {
+			r := f.shards.migration.to.For(k.group, k.channelName)
+			if byTarget[r] == nil {
+				byTarget[r] = make(map[incrByKey]int)
+			}
+			byTarget[r][k] = delta
+		}
+		for r, shardDeltas := range byTarget {
+			if err := pipelineIncrByOnSession(r, shardDeltas); err != nil {
+				return fmt.Errorf("dual-write to migration target failed: %s", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// groupDeltasByShard buckets deltas by the Redis session each key's
+// (group, channelName) routes to, so pipelineIncrBy can issue one pipeline
+// per shard instead of one ZINCRBY per key.
+func (f *Controller) groupDeltasByShard(deltas map[incrByKey]int) map[*redis.RedisSession]map[incrByKey]int {
+	byShard := make(map[*redis.RedisSession]map[incrByKey]int)
+	for k, delta := range deltas {
+		r := f.shardFor(k.group, k.channelName)
+		if byShard[r] == nil {
+			byShard[r] = make(map[incrByKey]int)
+		}
+		byShard[r][k] = delta
+	}
+
+	return byShard
+}
+
+func pipelineIncrByOnSession(r *redis.RedisSession, deltas map[incrByKey]int) error {
+	conn := r.Pool().Get()
+	defer conn.Close()
+
+	for k, delta := range deltas {
+		if err := conn.Send("ZINCRBY", k.key, delta, k.member); err != nil {
+			return err
+		}
+	}
+
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+
+	for i := 0; i < len(deltas); i++ {
+		if _, err := conn.Receive(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f *Controller) ack(p *pendingInteraction) {
+	p.delivery.Ack(false)
+}
+
+func (f *Controller) nack(p *pendingInteraction, err error) {
+	f.DefaultErrHandler(p.delivery, err)
+}
+
+func (f *Controller) nackAll(pending []*pendingInteraction, err error) {
+	for _, p := range pending {
+		f.nack(p, err)
+	}
+}
@@ -0,0 +1,72 @@
+package popularpost
+
+import (
+	"testing"
+
+	"github.com/koding/redis"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestIncrByKeyAsMapKey(t *testing.T) {
+	Convey("given two incrByKeys describing the same bucket member", t, func() {
+		a := incrByKey{key: "daily:1", member: 42, group: "koding", channelName: "general"}
+		b := incrByKey{key: "daily:1", member: 42, group: "koding", channelName: "general"}
+
+		Convey("they should collide in a map, so duplicate deltas merge", func() {
+			deltas := make(map[incrByKey]int)
+			deltas[a] += 3
+			deltas[b] += 4
+
+			So(len(deltas), ShouldEqual, 1)
+			So(deltas[a], ShouldEqual, 7)
+		})
+
+		Convey("a different member should not collide even under the same key", func() {
+			c := incrByKey{key: "daily:1", member: 43, group: "koding", channelName: "general"}
+
+			deltas := make(map[incrByKey]int)
+			deltas[a] += 3
+			deltas[c] += 4
+
+			So(len(deltas), ShouldEqual, 2)
+		})
+	})
+}
+
+func TestGroupDeltasByShard(t *testing.T) {
+	Convey("given a Controller with no shards configured", t, func() {
+		f := &Controller{redis: &redis.RedisSession{}}
+
+		deltas := map[incrByKey]int{
+			{key: "daily:1", member: 1, group: "koding", channelName: "general"}: 1,
+			{key: "daily:1", member: 2, group: "koding", channelName: "random"}:  2,
+		}
+
+		Convey("every key should land on f.redis regardless of (group, channel)", func() {
+			byShard := f.groupDeltasByShard(deltas)
+
+			So(len(byShard), ShouldEqual, 1)
+			So(len(byShard[f.redis]), ShouldEqual, 2)
+		})
+	})
+
+	Convey("given a Controller with shards configured", t, func() {
+		shards := NewShardedRedis([]*redis.RedisSession{{}, {}, {}})
+		f := &Controller{redis: &redis.RedisSession{}, shards: shards}
+
+		deltas := map[incrByKey]int{
+			{key: "daily:1", member: 1, group: "groupA", channelName: "chanA"}: 5,
+			{key: "daily:1", member: 2, group: "groupB", channelName: "chanB"}: 9,
+		}
+
+		Convey("each key should be grouped under the shard its (group, channel) routes to", func() {
+			byShard := f.groupDeltasByShard(deltas)
+
+			for k, delta := range deltas {
+				want := shards.For(k.group, k.channelName)
+				So(byShard[want][k], ShouldEqual, delta)
+			}
+		})
+	})
+}
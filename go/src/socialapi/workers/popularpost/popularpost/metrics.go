@@ -0,0 +1,46 @@
+package popularpost
+
+import (
+	"sync"
+	"time"
+)
+
+// batchMetrics tracks lightweight counters for the batch flusher so
+// operators can see flush size and lag without a full metrics backend.
+type batchMetrics struct {
+	mu sync.Mutex
+
+	flushCount int64
+	itemCount  int64
+	lastSize   int
+	lastLag    time.Duration
+}
+
+func newBatchMetrics() *batchMetrics {
+	return &batchMetrics{}
+}
+
+// observeFlush records that a flush of the given size took lag to complete
+// since the batch was opened.
+func (m *batchMetrics) observeFlush(size int, lag time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.flushCount++
+	m.itemCount += int64(size)
+	m.lastSize = size
+	m.lastLag = lag
+}
+
+// Snapshot returns the current counters for reporting.
+func (m *batchMetrics) Snapshot() (flushCount, itemCount int64, lastSize int, lastLag time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.flushCount, m.itemCount, m.lastSize, m.lastLag
+}
+
+// Snapshot exposes the Controller's batch-flusher metrics.
+func (f *Controller) Snapshot() (flushCount, itemCount int64, lastSize int, lastLag time.Duration) {
+	return f.metrics.Snapshot()
+}
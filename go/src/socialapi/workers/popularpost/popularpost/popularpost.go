@@ -18,6 +18,48 @@ var (
 type Controller struct {
 	log   logging.Logger
 	redis *redis.RedisSession
+
+	// batch buffers interactions enqueued via EnqueueInteraction until
+	// runBatch flushes them; New allocates it with room for DefaultMaxBatch
+	// entries, whether or not a flusher is ever started.
+	batch   chan *pendingInteraction
+	metrics *batchMetrics
+
+	// rankingAlgorithm selects which additional scoring scheme
+	// handleInteraction maintains alongside the legacy 7-day bucket.
+	// RankingSevenDayBucket (the zero value) keeps the original behavior.
+	rankingAlgorithm RankingAlgorithm
+
+	// shards routes popular-post keys across multiple Redis nodes. nil
+	// means every key stays on redis, as before sharding was introduced.
+	shards *ShardedRedis
+
+	// limiter caps how often a single hot post can issue a ZINCRBY.
+	limiter *rateLimiter
+}
+
+// SetRateLimits enables per-group write rate limiting, using settings for
+// any group without its own override. Increments held back by an empty
+// bucket are written together with the next increment for the same message
+// that either finds a token or arrives at least flushInterval after that
+// message's last write. Nothing flushes them on a timer: they stay unwritten
+// until another increment for that message arrives.
+func (f *Controller) SetRateLimits(settings *PopularPostSettings, flushInterval time.Duration) {
+	f.limiter = newRateLimiter(settings, flushInterval)
+}
+
+// SetShards enables sharded storage, routing every popular-post key across
+// shards instead of f.redis. Pass nil to go back to the single-instance
+// behavior.
+func (f *Controller) SetShards(shards *ShardedRedis) {
+	f.shards = shards
+}
+
+// SetRankingAlgorithm changes which scoring scheme handleInteraction
+// maintains going forward. It does not affect data already written under a
+// previous algorithm.
+func (f *Controller) SetRankingAlgorithm(algo RankingAlgorithm) {
+	f.rankingAlgorithm = algo
 }
 
 func (t *Controller) DefaultErrHandler(delivery amqp.Delivery, err error) bool {
@@ -34,8 +76,10 @@ func (t *Controller) DefaultErrHandler(delivery amqp.Delivery, err error) bool {
 
 func New(log logging.Logger, redis *redis.RedisSession) *Controller {
 	return &Controller{
-		log:   log,
-		redis: redis,
+		log:     log,
+		redis:   redis,
+		batch:   make(chan *pendingInteraction, DefaultMaxBatch),
+		metrics: newBatchMetrics(),
 	}
 }
 
@@ -68,31 +112,60 @@ func (f *Controller) handleInteraction(incrementCount int, i *models.Interaction
 		return nil
 	}
 
-	err = f.saveToDailyBucket(c, cm, i, incrementCount)
-	if err != nil {
+	if f.limiter != nil {
+		delta, ok := f.limiter.allow(c.GroupName, c.Name, c.TypeConstant, cm.Id, incrementCount)
+		if !ok {
+			return nil
+		}
+		incrementCount = delta
+
+		if err := f.writeBuckets(c, cm, i, incrementCount); err != nil {
+			f.limiter.refund(c.GroupName, c.Name, cm.Id, incrementCount)
+			return err
+		}
+
+		return nil
+	}
+
+	return f.writeBuckets(c, cm, i, incrementCount)
+}
+
+// writeBuckets applies incrementCount to every bucket handleInteraction
+// maintains for cm: the legacy daily/7-day buckets, plus whichever extra
+// ranking algorithm is configured.
+func (f *Controller) writeBuckets(c *models.Channel, cm *models.ChannelMessage, i *models.Interaction, incrementCount int) error {
+	if err := f.saveToDailyBucket(c, cm, i, incrementCount); err != nil {
 		return err
 	}
 
-	err = f.saveToSevenDayBucket(c, cm, i, incrementCount)
-	if err != nil {
+	if err := f.saveToSevenDayBucket(c, cm, i, incrementCount); err != nil {
 		return err
 	}
 
-	return nil
+	return f.writeRankingBucket(c, cm, i, incrementCount)
 }
 
 func (f *Controller) saveToDailyBucket(c *models.Channel, cm *models.ChannelMessage, i *models.Interaction, incrementCount int) error {
 	key := GetDailyKey(c, cm.CreatedAt)
-	_, err := f.redis.SortedSetIncrBy(key, incrementCount, cm.Id)
 
-	return err
+	err := f.shardWrite(c.GroupName, c.Name, func(r *redis.RedisSession) error {
+		_, err := r.SortedSetIncrBy(key, incrementCount, cm.Id)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	f.expire(c.GroupName, c.Name, key, dailyKeyTTL(cm.CreatedAt))
+
+	return nil
 }
 
 func (f *Controller) saveToSevenDayBucket(c *models.Channel, cm *models.ChannelMessage, i *models.Interaction, incrementCount int) error {
 	key := GetSevenDayKey(c, cm)
 	from := getStartOfDay(cm.CreatedAt)
 
-	exists := f.redis.Exists(key)
+	exists := f.shardFor(c.GroupName, c.Name).Exists(key)
 	if !exists {
 		err := f.createSevenDayCombinedBucket(c, cm, key, from)
 		if err != nil {
@@ -100,9 +173,17 @@ func (f *Controller) saveToSevenDayBucket(c *models.Channel, cm *models.ChannelM
 		}
 	}
 
-	_, err := f.redis.SortedSetIncrBy(key, incrementCount, cm.Id)
+	err := f.shardWrite(c.GroupName, c.Name, func(r *redis.RedisSession) error {
+		_, err := r.SortedSetIncrBy(key, incrementCount, cm.Id)
+		return err
+	})
+	if err != nil {
+		return err
+	}
 
-	return err
+	f.expire(c.GroupName, c.Name, key, sevenDayKeyTTL(cm.CreatedAt))
+
+	return nil
 }
 
 func (f *Controller) createSevenDayCombinedBucket(c *models.Channel, cm *models.ChannelMessage, key string, from time.Time) error {
@@ -123,9 +204,10 @@ func (f *Controller) createSevenDayCombinedBucket(c *models.Channel, cm *models.
 		weights = append(weights, float64(1/weight))
 	}
 
-	_, err := f.redis.SortedSetsUnion(key, keys, weights, aggregate)
-
-	return err
+	return f.shardWrite(c.GroupName, c.Name, func(r *redis.RedisSession) error {
+		_, err := r.SortedSetsUnion(key, keys, weights, aggregate)
+		return err
+	})
 }
 
 //----------------------------------------------------------
@@ -0,0 +1,203 @@
+package popularpost
+
+import (
+	"fmt"
+	"net/http"
+	"socialapi/config"
+	"socialapi/models"
+	"strings"
+
+	"github.com/koding/bongo"
+)
+
+// PurgeResult reports how many keys and sorted-set members a purge removed.
+type PurgeResult struct {
+	KeysPurged    int `json:"keysPurged"`
+	MembersPurged int `json:"membersPurged"`
+}
+
+// PurgeMessage removes message's entries from every popular-post bucket it
+// could be a member of. Wire this into the message-delete and
+// mark-as-troll event handlers so a removed or trolled message stops
+// showing up as popular immediately, instead of waiting for it to fail
+// notEligibleForPopularPost at the next purge sweep.
+func (f *Controller) PurgeMessage(messageId int64) error {
+	cm, err := models.ChannelMessageById(messageId)
+	if err != nil {
+		return err
+	}
+
+	c, err := models.ChannelById(cm.InitialChannelId)
+	if err != nil {
+		return err
+	}
+
+	r := f.shardFor(c.GroupName, c.Name)
+
+	keys := []string{
+		GetDailyKey(c, cm.CreatedAt),
+		GetHotKey(c),
+		GetDecayKey(c),
+		GetVotesKey(c),
+	}
+	// cm's daily bucket is unioned into the 7-day bucket of every anchor day
+	// from its creation day through the seven days after it.
+	for i := 0; i <= 7; i++ {
+		anchor := &models.ChannelMessage{CreatedAt: getXDaysAgo(cm.CreatedAt, -i)}
+		keys = append(keys, GetSevenDayKey(c, anchor))
+	}
+
+	for _, key := range keys {
+		if _, err := r.SortedSetRemove(key, cm.Id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// purgeableSession is the subset of *redis.RedisSession PurgeLapsed needs;
+// f.redis and every session in f.shards satisfy it.
+type purgeableSession interface {
+	Keys(string) ([]string, error)
+	TTL(string) (int64, error)
+	Del(string) (int64, error)
+	SortedSetMembers(string) ([]int64, error)
+	SortedSetRemove(string, int64) (int64, error)
+}
+
+// PurgeLapsed scans every popular-post key under the configured
+// environment prefix and removes (1) every such key that has no TTL set
+// (e.g. written before TTLs were introduced), and (2) individual members
+// that now fail notEligibleForPopularPost. A key without a TTL is removed
+// whatever day it covers; its age is not checked.
+func (f *Controller) PurgeLapsed() (*PurgeResult, error) {
+	prefix := fmt.Sprintf("%s:*:%s:*", config.MustGet().Environment, PopularPostKey)
+
+	sessions := []purgeableSession{f.redis}
+	if f.shards != nil {
+		sessions = sessions[:0]
+		for _, s := range f.shards.shards {
+			sessions = append(sessions, s)
+		}
+	}
+
+	result := &PurgeResult{}
+
+	for _, session := range sessions {
+		keys, err := session.Keys(prefix)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range keys {
+			purged, members, err := f.purgeKey(session, key)
+			if err != nil {
+				return nil, err
+			}
+
+			if purged {
+				result.KeysPurged++
+			}
+			result.MembersPurged += members
+		}
+	}
+
+	return result, nil
+}
+
+// purgeKey deletes key outright if it has no TTL set, whatever its age, or
+// otherwise drops any member that is no longer eligible.
+func (f *Controller) purgeKey(r purgeableSession, key string) (bool, int, error) {
+	ttl, err := r.TTL(key)
+	if err != nil {
+		return false, 0, err
+	}
+
+	if ttl < 0 && isLapsedKey(key) {
+		if _, err := r.Del(key); err != nil {
+			return false, 0, err
+		}
+		return true, 0, nil
+	}
+
+	members, err := r.SortedSetMembers(key)
+	if err != nil {
+		return false, 0, err
+	}
+
+	purgedMembers := 0
+	for _, messageId := range members {
+		cm, err := models.ChannelMessageById(messageId)
+		if err == bongo.RecordNotFound {
+			// Message is gone entirely - treat it the same as ineligible.
+			if _, err := r.SortedSetRemove(key, messageId); err == nil {
+				purgedMembers++
+			}
+			continue
+		}
+		if err != nil {
+			// A transient lookup failure isn't evidence the message is
+			// gone - leave the member alone rather than risk deleting a
+			// legitimate entry, and let the next sweep retry it.
+			f.log.Error(fmt.Sprintf("purge: couldn't look up message %d, leaving it alone: %s", messageId, err))
+			continue
+		}
+
+		c, err := models.ChannelById(cm.InitialChannelId)
+		if err == bongo.RecordNotFound {
+			if _, err := r.SortedSetRemove(key, messageId); err == nil {
+				purgedMembers++
+			}
+			continue
+		}
+		if err != nil {
+			f.log.Error(fmt.Sprintf("purge: couldn't look up channel %d, leaving message %d alone: %s", cm.InitialChannelId, messageId, err))
+			continue
+		}
+
+		if notEligibleForPopularPost(c, cm) {
+			if _, err := r.SortedSetRemove(key, messageId); err == nil {
+				purgedMembers++
+			}
+		}
+	}
+
+	return false, purgedMembers, nil
+}
+
+// isLapsedKey reports whether key contains the popular-post segment, as
+// the daily, 7-day, hot, decay, votes and read keys all do, so PurgeLapsed
+// doesn't touch unrelated keys that happen to share the environment prefix.
+// It does not look at the day a key covers.
+func isLapsedKey(key string) bool {
+	return strings.Contains(key, ":"+PopularPostKey+":")
+}
+
+// PurgeHandler returns an http.HandlerFunc for
+// POST /popularpost/purge?scope=lapsed. Callers should wrap it with the
+// same admin-auth middleware used by the rest of socialapi's admin routes
+// before registering it on the mux.
+func (f *Controller) PurgeHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if scope := r.URL.Query().Get("scope"); scope != "lapsed" {
+			http.Error(w, fmt.Sprintf("unsupported scope: %q", scope), http.StatusBadRequest)
+			return
+		}
+
+		result, err := f.PurgeLapsed()
+		if err != nil {
+			f.log.Error(fmt.Sprintf("purge lapsed popular posts failed: %s", err))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"keysPurged":%d,"membersPurged":%d}`, result.KeysPurged, result.MembersPurged)
+	}
+}
@@ -0,0 +1,205 @@
+package popularpost
+
+import (
+	"fmt"
+	"math"
+	"socialapi/models"
+	"time"
+
+	"github.com/koding/redis"
+)
+
+// RankingAlgorithm selects how a channel's popular posts are scored.
+type RankingAlgorithm int
+
+const (
+	// RankingSevenDayBucket is the original scheme: a per-day sorted set
+	// unioned into a combined 7-day bucket with a 1/i day weight.
+	RankingSevenDayBucket RankingAlgorithm = iota
+
+	// RankingHot scores posts the way Reddit's "hot" sort does - a log of
+	// the net vote count plus a term linear in the post's age, so newer
+	// posts with the same vote count rank higher.
+	RankingHot
+
+	// RankingDecay keeps a single per-channel sorted set whose scores are
+	// continuously decayed, giving a real-time trending order without a
+	// 7-day union rebuild.
+	RankingDecay
+)
+
+// hotEpoch is the reference point hot scores are measured from, matching
+// Reddit's original "hot" epoch (2005-12-08T07:46:43Z).
+var hotEpoch = time.Date(2005, time.December, 8, 7, 46, 43, 0, time.UTC)
+
+// decayLambda controls how quickly RankingDecay scores fall off; a delta
+// added right now is worth half as much after roughly 6 hours.
+const decayLambda = math.Ln2 / (6 * 60 * 60)
+
+// GetHotKey returns the sorted set that holds Reddit-style "hot" scores for
+// a channel. Unlike the daily buckets, it is not keyed by day: the score
+// itself already encodes recency.
+func GetHotKey(c *models.Channel) string {
+	return PreparePopularPostKey(c.GroupName, c.Name, 0) + ":hot"
+}
+
+// GetDecayKey returns the sorted set that holds exponentially decayed
+// scores for a channel.
+func GetDecayKey(c *models.Channel) string {
+	return PreparePopularPostKey(c.GroupName, c.Name, 0) + ":decay"
+}
+
+// GetVotesKey returns the sorted set that tracks each message's cumulative
+// net vote count. hotScore needs the running total, not the single event's
+// ±1 delta, so this is kept separately from GetHotKey instead of being
+// derived from it.
+func GetVotesKey(c *models.Channel) string {
+	return PreparePopularPostKey(c.GroupName, c.Name, 0) + ":votes"
+}
+
+// writeRankingBucket applies incrementCount to whichever extra ranking
+// scheme is configured, on top of the legacy daily/7-day buckets.
+// handleInteraction and flushBatch both call this - neither should
+// duplicate the switch, so a new RankingAlgorithm only needs wiring up in
+// one place to be honored on both the synchronous and batched paths.
+func (f *Controller) writeRankingBucket(c *models.Channel, cm *models.ChannelMessage, i *models.Interaction, incrementCount int) error {
+	switch f.rankingAlgorithm {
+	case RankingHot:
+		return f.saveToHotBucket(c, cm, i, incrementCount)
+	case RankingDecay:
+		return f.saveToDecayBucket(c, cm, i, incrementCount)
+	}
+
+	return nil
+}
+
+// saveToHotBucket writes a Reddit-style hot score for cm, recomputed from
+// its cumulative net vote count so the score actually moves as more votes
+// come in instead of being overwritten with the same value every time.
+func (f *Controller) saveToHotBucket(c *models.Channel, cm *models.ChannelMessage, i *models.Interaction, incrementCount int) error {
+	key := GetHotKey(c)
+	votesKey := GetVotesKey(c)
+
+	err := f.shardWrite(c.GroupName, c.Name, func(r *redis.RedisSession) error {
+		votes, err := r.SortedSetIncrBy(votesKey, incrementCount, cm.Id)
+		if err != nil {
+			return err
+		}
+
+		score := hotScore(cm.CreatedAt, float64(votes))
+		_, err = r.ZAdd(key, score, cm.Id)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	f.expire(c.GroupName, c.Name, votesKey, rankingKeyTTL)
+	f.expire(c.GroupName, c.Name, key, rankingKeyTTL)
+
+	return nil
+}
+
+// hotScore implements the classic Reddit "hot" formula: log10 of the
+// magnitude of the net vote count, signed, plus the post's creation time in
+// seconds since hotEpoch, scaled down so votes dominate over the first few days and age takes over
+// after that. net is the message's cumulative net vote count, not a single
+// event's delta - recomputing it from the running total is what makes the
+// score actually move as more votes come in.
+func hotScore(createdAt time.Time, net float64) float64 {
+	order := math.Log10(math.Max(math.Abs(net), 1))
+
+	sign := 0.0
+	switch {
+	case net > 0:
+		sign = 1
+	case net < 0:
+		sign = -1
+	}
+
+	seconds := createdAt.Sub(hotEpoch).Seconds()
+
+	return sign*order + seconds/45000
+}
+
+// saveToDecayBucket adds an exponentially decayed increment to cm's score in
+// the channel's decay bucket: an interaction arriving age seconds after cm
+// was created contributes less than the same interaction arriving fresh.
+func (f *Controller) saveToDecayBucket(c *models.Channel, cm *models.ChannelMessage, i *models.Interaction, incrementCount int) error {
+	key := GetDecayKey(c)
+	age := time.Since(cm.CreatedAt).Seconds()
+	delta := float64(incrementCount) * math.Exp(-decayLambda*age)
+
+	err := f.shardWrite(c.GroupName, c.Name, func(r *redis.RedisSession) error {
+		_, err := r.SortedSetIncrByFloat(key, delta, cm.Id)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	f.expire(c.GroupName, c.Name, key, rankingKeyTTL)
+
+	return nil
+}
+
+// DecaySweep re-decays every member of c's decay bucket by factor, so that
+// a channel's decay bucket keeps shrinking even for posts that receive no
+// new votes.
+//
+// Unlike runBatch, this package has no StartDecaySweeper: driving this
+// periodically means calling it once per channel using RankingDecay, and
+// this package has no registry of channels to enumerate - only whatever
+// wires it up (e.g. a cron-style worker elsewhere in socialapi that already
+// knows which channels exist) does. DecaySweep is exported so that caller
+// has something to call; it is not itself runnable on a schedule.
+func (f *Controller) DecaySweep(c *models.Channel, factor float64) error {
+	key := GetDecayKey(c)
+	return f.shardFor(c.GroupName, c.Name).ScaleSortedSet(key, factor)
+}
+
+// GetPopular returns the top limit message ids for channel ranked by algo.
+func (f *Controller) GetPopular(c *models.Channel, algo RankingAlgorithm, limit int) ([]int64, error) {
+	r := f.shardFor(c.GroupName, c.Name)
+
+	switch algo {
+	case RankingHot:
+		return r.SortedSetReverseRange(GetHotKey(c), limit)
+	case RankingDecay:
+		return r.SortedSetReverseRange(GetDecayKey(c), limit)
+	case RankingSevenDayBucket:
+		return f.getSevenDayPopular(c, limit)
+	default:
+		return nil, fmt.Errorf("unknown ranking algorithm: %d", algo)
+	}
+}
+
+// getSevenDayPopular reads the channel's current popular posts under the
+// legacy scheme. createSevenDayCombinedBucket anchors a combined bucket to
+// each post's own creation day, so a post created yesterday lives under a
+// different key than one created today; this unions every anchor day still
+// within the trailing week into a short-lived read key instead of only
+// looking at today's, which would miss every post not created today.
+func (f *Controller) getSevenDayPopular(c *models.Channel, limit int) ([]int64, error) {
+	r := f.shardFor(c.GroupName, c.Name)
+	today := getStartOfDay(time.Now().UTC())
+
+	keys, weights := []interface{}{}, []interface{}{}
+	for i := 0; i <= 7; i++ {
+		anchor := getXDaysAgo(today, i)
+		keys = append(keys, GetSevenDayKey(c, &models.ChannelMessage{CreatedAt: anchor}))
+		weights = append(weights, float64(1))
+	}
+
+	readKey := PreparePopularPostKey(c.GroupName, c.Name, today.Unix()) + ":read"
+
+	if _, err := r.SortedSetsUnion(readKey, keys, weights, "MAX"); err != nil {
+		return nil, err
+	}
+
+	if _, err := r.Expire(readKey, time.Minute); err != nil {
+		f.log.Error(fmt.Sprintf("failed to set TTL on %s: %s", readKey, err))
+	}
+
+	return r.SortedSetReverseRange(readKey, limit)
+}
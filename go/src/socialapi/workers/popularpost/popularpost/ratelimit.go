@@ -0,0 +1,274 @@
+package popularpost
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// PopularPostSetting is the per-group override for write rate limiting,
+// analogous to the per-group overrides resource-group settings already
+// uses elsewhere in socialapi.
+type PopularPostSetting struct {
+	// FillRate is how many tokens the bucket gains per second.
+	FillRate float64
+
+	// BurstLimit is the bucket's capacity - the largest burst of
+	// unthrottled ZINCRBYs a hot post can cause before limiting kicks in.
+	BurstLimit float64
+
+	// JobTypes, when non-empty, excludes the listed channel type constants
+	// (e.g. models.Channel_TYPE_ANNOUNCEMENT) from limiting entirely.
+	JobTypes []string
+}
+
+var defaultPopularPostSetting = PopularPostSetting{
+	FillRate:   1,
+	BurstLimit: 5,
+}
+
+// PopularPostSettings holds the per-group overrides, keyed by group name.
+// Groups with no override use defaultPopularPostSetting.
+type PopularPostSettings struct {
+	mu      sync.RWMutex
+	byGroup map[string]PopularPostSetting
+}
+
+// NewPopularPostSettings returns an empty settings table; every group uses
+// defaultPopularPostSetting until Set is called for it.
+func NewPopularPostSettings() *PopularPostSettings {
+	return &PopularPostSettings{byGroup: make(map[string]PopularPostSetting)}
+}
+
+// Set installs an override for group.
+func (s *PopularPostSettings) Set(group string, setting PopularPostSetting) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.byGroup[group] = setting
+}
+
+func (s *PopularPostSettings) get(group string) PopularPostSetting {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if setting, ok := s.byGroup[group]; ok {
+		return setting
+	}
+
+	return defaultPopularPostSetting
+}
+
+func (s PopularPostSetting) excludes(channelType string) bool {
+	for _, t := range s.JobTypes {
+		if t == channelType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tokenBucket is a standard token-bucket limiter: it holds at most
+// burst tokens, refilled continuously at fillRate tokens/sec, and
+// accumulates the increments that arrived while it was empty so nothing is
+// silently dropped.
+type tokenBucket struct {
+	mu sync.Mutex
+
+	fillRate   float64
+	burst      float64
+	tokens     float64
+	lastRefill time.Time
+
+	pending      int
+	lastFlushed  time.Time
+	lastAccessed time.Time
+}
+
+func newTokenBucket(setting PopularPostSetting) *tokenBucket {
+	now := time.Now()
+	return &tokenBucket{
+		fillRate:     setting.FillRate,
+		burst:        setting.BurstLimit,
+		tokens:       setting.BurstLimit,
+		lastRefill:   now,
+		lastAccessed: now,
+	}
+}
+
+// applySetting refreshes the rate the bucket refills at, so a change made
+// through PopularPostSettings.Set takes effect on a post that's already
+// being limited, not just on posts first seen afterwards.
+func (b *tokenBucket) applySetting(setting PopularPostSetting) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.fillRate = setting.FillRate
+	b.burst = setting.BurstLimit
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	elapsed := now.Sub(b.lastRefill).Seconds()
+	b.lastRefill = now
+
+	b.tokens += elapsed * b.fillRate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// offer adds incrementCount to the bucket's pending total and reports
+// whether the caller should flush now - either because a token is
+// available, or because flushInterval has elapsed since the last flush
+// regardless of tokens, so eventual accuracy doesn't stall under sustained
+// load. The returned delta is only committed once the caller has written it
+// to Redis; if the write fails the caller must call refund(delta) so the
+// count isn't lost.
+func (b *tokenBucket) offer(incrementCount int, flushInterval time.Duration) (delta int, shouldFlush bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastAccessed = time.Now()
+	b.refill()
+	b.pending += incrementCount
+
+	if b.tokens >= 1 || time.Since(b.lastFlushed) >= flushInterval {
+		b.tokens--
+		if b.tokens < 0 {
+			b.tokens = 0
+		}
+
+		delta = b.pending
+		b.pending = 0
+		b.lastFlushed = time.Now()
+
+		return delta, true
+	}
+
+	return 0, false
+}
+
+// refund puts a delta that failed to write back into the pending total, so
+// it's included in the next successful flush instead of being lost.
+func (b *tokenBucket) refund(delta int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.pending += delta
+}
+
+func (b *tokenBucket) idleSince() time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.lastAccessed
+}
+
+func (b *tokenBucket) hasPending() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.pending != 0
+}
+
+// maxBucketIdle is how long a tokenBucket can go unused before the next
+// sweep evicts it - well short of createdMoreThan7DaysAgo's window, so a
+// post's bucket is gone long before the post itself stops being a candidate.
+// A bucket still holding pending increments is not evicted.
+const maxBucketIdle = 24 * time.Hour
+
+// sweepInterval is the minimum time between eviction sweeps, so a busy
+// limiter doesn't pay the cost of walking the whole map on every call.
+const sweepInterval = 10 * time.Minute
+
+// rateLimiter caps how often a single (group, channel, messageId) triple may
+// issue a ZINCRBY, coalescing increments that arrive while its bucket is
+// empty into one larger ZINCRBY, sent with the next increment for that
+// triple that allow lets through.
+type rateLimiter struct {
+	settings      *PopularPostSettings
+	flushInterval time.Duration
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(settings *PopularPostSettings, flushInterval time.Duration) *rateLimiter {
+	return &rateLimiter{
+		settings:      settings,
+		flushInterval: flushInterval,
+		buckets:       make(map[string]*tokenBucket),
+		lastSweep:     time.Now(),
+	}
+}
+
+func rateLimitKey(group, channelName string, messageId int64) string {
+	return group + ":" + channelName + ":" + strconv.FormatInt(messageId, 10)
+}
+
+// allow returns the delta that should actually be sent to Redis for this
+// increment, and whether anything should be sent at all right now. On a
+// false/zero result the caller owes nothing; on a true result the caller
+// writes the delta and, if that write fails, calls refund with it.
+func (l *rateLimiter) allow(group, channelName, channelType string, messageId int64, incrementCount int) (int, bool) {
+	setting := l.settings.get(group)
+	if setting.excludes(channelType) {
+		return incrementCount, true
+	}
+
+	key := rateLimitKey(group, channelName, messageId)
+
+	l.mu.Lock()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = newTokenBucket(setting)
+		l.buckets[key] = b
+	} else {
+		b.applySetting(setting)
+	}
+	l.maybeSweepLocked()
+	l.mu.Unlock()
+
+	return b.offer(incrementCount, l.flushInterval)
+}
+
+// refund puts a delta that failed to reach Redis back into the bucket it
+// came from, so the count isn't silently dropped.
+func (l *rateLimiter) refund(group, channelName string, messageId int64, delta int) {
+	if delta == 0 {
+		return
+	}
+
+	key := rateLimitKey(group, channelName, messageId)
+
+	l.mu.Lock()
+	b, ok := l.buckets[key]
+	l.mu.Unlock()
+
+	if ok {
+		b.refund(delta)
+	}
+}
+
+// maybeSweepLocked removes buckets idle for longer than maxBucketIdle that
+// hold no pending increments. l.mu must already be held.
+func (l *rateLimiter) maybeSweepLocked() {
+	now := time.Now()
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	for key, b := range l.buckets {
+		if now.Sub(b.idleSince()) > maxBucketIdle && !b.hasPending() {
+			delete(l.buckets, key)
+		}
+	}
+}
+
@@ -0,0 +1,145 @@
+package popularpost
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPopularPostSettings(t *testing.T) {
+	Convey("given an empty PopularPostSettings table", t, func() {
+		settings := NewPopularPostSettings()
+
+		Convey("a group with no override should get defaultPopularPostSetting", func() {
+			So(settings.get("koding"), ShouldResemble, defaultPopularPostSetting)
+		})
+
+		Convey("Set should install an override that get then returns", func() {
+			override := PopularPostSetting{FillRate: 10, BurstLimit: 50}
+			settings.Set("koding", override)
+
+			So(settings.get("koding"), ShouldResemble, override)
+			So(settings.get("someOtherGroup"), ShouldResemble, defaultPopularPostSetting)
+		})
+	})
+}
+
+func TestPopularPostSettingExcludes(t *testing.T) {
+	Convey("given a setting with JobTypes configured", t, func() {
+		setting := PopularPostSetting{JobTypes: []string{"announcement"}}
+
+		Convey("it should exclude a listed channel type", func() {
+			So(setting.excludes("announcement"), ShouldBeTrue)
+		})
+
+		Convey("it should not exclude an unlisted channel type", func() {
+			So(setting.excludes("post"), ShouldBeFalse)
+		})
+	})
+}
+
+func TestTokenBucketOffer(t *testing.T) {
+	Convey("given a fresh token bucket at full burst", t, func() {
+		b := newTokenBucket(PopularPostSetting{FillRate: 1, BurstLimit: 5})
+
+		Convey("an increment should flush immediately while tokens remain", func() {
+			delta, shouldFlush := b.offer(3, time.Hour)
+
+			So(shouldFlush, ShouldBeTrue)
+			So(delta, ShouldEqual, 3)
+		})
+
+		Convey("increments should accumulate in pending once tokens are exhausted", func() {
+			for i := 0; i < 5; i++ {
+				b.offer(1, time.Hour)
+			}
+
+			delta, shouldFlush := b.offer(2, time.Hour)
+
+			So(shouldFlush, ShouldBeFalse)
+			So(delta, ShouldEqual, 0)
+			So(b.pending, ShouldEqual, 2)
+		})
+
+		Convey("a stalled bucket should still flush once flushInterval elapses", func() {
+			for i := 0; i < 5; i++ {
+				b.offer(1, 0)
+			}
+
+			delta, shouldFlush := b.offer(4, 0)
+
+			So(shouldFlush, ShouldBeTrue)
+			So(delta, ShouldEqual, 4)
+		})
+	})
+}
+
+func TestTokenBucketRefund(t *testing.T) {
+	Convey("given a token bucket that already has pending increments", t, func() {
+		b := newTokenBucket(PopularPostSetting{FillRate: 1, BurstLimit: 5})
+		b.pending = 3
+
+		Convey("refund should add back into pending rather than replace it", func() {
+			b.refund(4)
+
+			So(b.pending, ShouldEqual, 7)
+		})
+	})
+}
+
+func TestTokenBucketApplySetting(t *testing.T) {
+	Convey("given a token bucket sitting at its original burst limit", t, func() {
+		b := newTokenBucket(PopularPostSetting{FillRate: 1, BurstLimit: 5})
+
+		Convey("applySetting should cap existing tokens down to a lower burst limit", func() {
+			b.applySetting(PopularPostSetting{FillRate: 2, BurstLimit: 2})
+
+			So(b.fillRate, ShouldEqual, 2)
+			So(b.tokens, ShouldEqual, 2)
+		})
+
+		Convey("applySetting should not raise tokens just because burst went up", func() {
+			b.tokens = 1
+			b.applySetting(PopularPostSetting{FillRate: 1, BurstLimit: 10})
+
+			So(b.tokens, ShouldEqual, 1)
+		})
+	})
+}
+
+func TestRateLimiterAllowAndRefund(t *testing.T) {
+	Convey("given a rateLimiter over a group with no override", t, func() {
+		settings := NewPopularPostSettings()
+		l := newRateLimiter(settings, time.Hour)
+
+		Convey("the first call for a message should flush up to the configured burst", func() {
+			delta, ok := l.allow("koding", "general", "post", 1, 3)
+
+			So(ok, ShouldBeTrue)
+			So(delta, ShouldEqual, 3)
+		})
+
+		Convey("an excluded channel type should always be allowed in full", func() {
+			settings.Set("koding", PopularPostSetting{JobTypes: []string{"announcement"}})
+
+			delta, ok := l.allow("koding", "general", "announcement", 1, 999)
+
+			So(ok, ShouldBeTrue)
+			So(delta, ShouldEqual, 999)
+		})
+
+		Convey("refund should return a failed delta to the same message's bucket", func() {
+			l.allow("koding", "general", "post", 1, int(defaultPopularPostSetting.BurstLimit))
+
+			l.refund("koding", "general", 1, 2)
+
+			b := l.buckets[rateLimitKey("koding", "general", 1)]
+			So(b.pending, ShouldEqual, 2)
+		})
+
+		Convey("refund for a message with no bucket yet should be a no-op", func() {
+			So(func() { l.refund("koding", "nosuchchannel", 42, 5) }, ShouldNotPanic)
+		})
+	})
+}
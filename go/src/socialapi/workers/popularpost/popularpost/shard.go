@@ -0,0 +1,88 @@
+package popularpost
+
+import (
+	"fmt"
+
+	"github.com/OneOfOne/xxhash"
+	"github.com/koding/redis"
+)
+
+// ShardedRedis routes popular-post keys across an ordered list of Redis
+// sessions. The shard for a given (group, channel) pair is deterministic,
+// so every write and read for that pair always lands on the same node -
+// required for createSevenDayCombinedBucket's ZUNIONSTORE, which needs all
+// of its source keys to live on one instance.
+type ShardedRedis struct {
+	shards    []*redis.RedisSession
+	migration *migrationTarget
+}
+
+// NewShardedRedis builds a ShardedRedis over shards. The order of shards
+// must stay stable across deploys, since it determines which node an
+// existing key hashes to; reordering it silently "moves" data until a
+// migration is run.
+func NewShardedRedis(shards []*redis.RedisSession) *ShardedRedis {
+	return &ShardedRedis{shards: shards}
+}
+
+// Len returns the number of configured shards.
+func (s *ShardedRedis) Len() int {
+	return len(s.shards)
+}
+
+// For returns the Redis session responsible for group/channelName.
+func (s *ShardedRedis) For(group, channelName string) *redis.RedisSession {
+	return s.shards[s.index(group, channelName)]
+}
+
+func (s *ShardedRedis) index(group, channelName string) int {
+	sum := xxhash.ChecksumString64(group + channelName)
+	return int(sum % uint64(len(s.shards)))
+}
+
+// migrationTarget is set by BeginMigration to dual-write to a second shard
+// list while data is being rebalanced onto it.
+type migrationTarget struct {
+	to *ShardedRedis
+}
+
+// BeginMigration makes every subsequent write go to both the current shard
+// set and to, so keys are present on the new layout before traffic cuts
+// over. Call EndMigration once the new shard set has been backfilled.
+func (s *ShardedRedis) BeginMigration(to *ShardedRedis) {
+	s.migration = &migrationTarget{to: to}
+}
+
+// EndMigration stops dual-writing; subsequent writes go only to s's current
+// shards (which should by then be to's shards, swapped in by the caller).
+func (s *ShardedRedis) EndMigration() {
+	s.migration = nil
+}
+
+func (f *Controller) shardFor(group, channelName string) *redis.RedisSession {
+	if f.shards == nil {
+		return f.redis
+	}
+	return f.shards.For(group, channelName)
+}
+
+// shardWrite runs fn against the shard owning (group, channelName), and
+// again against the migration target's shard if a migration is in
+// progress.
+func (f *Controller) shardWrite(group, channelName string, fn func(*redis.RedisSession) error) error {
+	if f.shards == nil {
+		return fn(f.redis)
+	}
+
+	if err := fn(f.shards.For(group, channelName)); err != nil {
+		return err
+	}
+
+	if f.shards.migration != nil {
+		if err := fn(f.shards.migration.to.For(group, channelName)); err != nil {
+			return fmt.Errorf("dual-write to migration target failed: %s", err)
+		}
+	}
+
+	return nil
+}
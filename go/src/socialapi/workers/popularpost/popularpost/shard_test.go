@@ -0,0 +1,65 @@
+package popularpost
+
+import (
+	"testing"
+
+	"github.com/koding/redis"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestShardedRedis(t *testing.T) {
+	Convey("given a ShardedRedis over a handful of shards", t, func() {
+		shards := []*redis.RedisSession{{}, {}, {}, {}}
+		s := NewShardedRedis(shards)
+
+		Convey("Len should report the number of shards", func() {
+			So(s.Len(), ShouldEqual, len(shards))
+		})
+
+		Convey("For should always route the same (group, channel) pair to the same shard", func() {
+			first := s.For("koding", "general")
+			for i := 0; i < 10; i++ {
+				So(s.For("koding", "general"), ShouldEqual, first)
+			}
+		})
+
+		Convey("For should spread distinct channels across more than one shard", func() {
+			seen := make(map[*redis.RedisSession]bool)
+			for i := 0; i < 50; i++ {
+				channelName := "channel" + string(rune('a'+i%26)) + string(rune('0'+i/26))
+				seen[s.For("koding", channelName)] = true
+			}
+
+			So(len(seen), ShouldBeGreaterThan, 1)
+		})
+
+		Convey("index should never return an out-of-range shard", func() {
+			for i := 0; i < 50; i++ {
+				channelName := "channel" + string(rune('a'+i%26))
+				idx := s.index("koding", channelName)
+				So(idx, ShouldBeBetween, -1, len(shards))
+			}
+		})
+	})
+}
+
+func TestControllerShardFor(t *testing.T) {
+	Convey("given a Controller with no shards configured", t, func() {
+		f := &Controller{redis: &redis.RedisSession{}}
+
+		Convey("shardFor should always return f.redis", func() {
+			So(f.shardFor("koding", "general"), ShouldEqual, f.redis)
+		})
+	})
+
+	Convey("given a Controller with shards configured", t, func() {
+		shards := NewShardedRedis([]*redis.RedisSession{{}, {}})
+		f := &Controller{redis: &redis.RedisSession{}, shards: shards}
+
+		Convey("shardFor should defer to the shard set instead of f.redis", func() {
+			So(f.shardFor("koding", "general"), ShouldEqual, shards.For("koding", "general"))
+			So(f.shardFor("koding", "general"), ShouldNotEqual, f.redis)
+		})
+	})
+}
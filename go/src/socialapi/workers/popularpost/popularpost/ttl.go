@@ -0,0 +1,55 @@
+package popularpost
+
+import (
+	"fmt"
+	"time"
+)
+
+// retentionWindow is how long a daily bucket is kept around after the day
+// it covers - one day past the 7-day lookback window createSevenDayCombinedBucket
+// reads from, so a slow reader never hits an expired key mid-union.
+const retentionWindow = 8 * 24 * time.Hour
+
+// sevenDayRetentionWindow is how long a combined 7-day bucket is kept
+// around after its created-at day - just one day, not the full
+// retentionWindow, so a stale union gets rebuilt from the daily buckets'
+// current scores instead of serving week-old composition for another week.
+const sevenDayRetentionWindow = 24 * time.Hour
+
+// rankingKeyTTL is how long the hot/decay/vote-count keys live after a
+// write that touches them. They aren't anchored to a single day like the
+// daily/7-day buckets, so instead of a TTL computed from a fixed date, this
+// is refreshed on every write; without it, purgeKey would otherwise read
+// them as having no TTL at all and delete them outright on the next sweep.
+const rankingKeyTTL = 30 * 24 * time.Hour
+
+// dailyKeyTTL returns how long the daily bucket for date should live,
+// measured from now.
+func dailyKeyTTL(date time.Time) time.Duration {
+	return getStartOfDay(date).Add(retentionWindow).Sub(time.Now().UTC())
+}
+
+// sevenDayKeyTTL returns how long the combined 7-day bucket created from
+// createdAt should live, measured from now.
+func sevenDayKeyTTL(createdAt time.Time) time.Duration {
+	return getStartOfDay(createdAt).Add(sevenDayRetentionWindow).Sub(time.Now().UTC())
+}
+
+// expire sets key's TTL on the shard that owns it, logging (but not
+// failing the caller) if the EXPIRE itself errors - a missed expiry just
+// means PurgeLapsed cleans it up later.
+func (f *Controller) expire(group, channelName, key string, ttl time.Duration) {
+	if ttl <= 0 {
+		ttl = time.Second
+	}
+
+	if _, err := f.shardFor(group, channelName).Expire(key, ttl); err != nil {
+		f.log.Error(fmt.Sprintf("failed to set TTL on %s: %s", key, err))
+	}
+
+	if f.shards != nil && f.shards.migration != nil {
+		if _, err := f.shards.migration.to.For(group, channelName).Expire(key, ttl); err != nil {
+			f.log.Error(fmt.Sprintf("failed to set TTL on %s on migration target: %s", key, err))
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package popularpost
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDailyKeyTTL(t *testing.T) {
+	Convey("while computing a daily bucket's TTL", t, func() {
+		Convey("it should expire retentionWindow past the start of date's day", func() {
+			date := time.Now().UTC()
+			ttl := dailyKeyTTL(date)
+
+			wantAround := getStartOfDay(date).Add(retentionWindow).Sub(time.Now().UTC())
+			So(ttl, ShouldAlmostEqual, wantAround, float64(time.Second))
+		})
+
+		Convey("a date from yesterday should yield a smaller TTL than today", func() {
+			today := dailyKeyTTL(time.Now().UTC())
+			yesterday := dailyKeyTTL(getXDaysAgo(time.Now().UTC(), 1))
+
+			So(yesterday, ShouldBeLessThan, today)
+		})
+	})
+}
+
+func TestSevenDayKeyTTL(t *testing.T) {
+	Convey("while computing a combined 7-day bucket's TTL", t, func() {
+		Convey("it should expire sevenDayRetentionWindow past the start of createdAt's day, not retentionWindow", func() {
+			createdAt := time.Now().UTC()
+			ttl := sevenDayKeyTTL(createdAt)
+
+			wantAround := getStartOfDay(createdAt).Add(sevenDayRetentionWindow).Sub(time.Now().UTC())
+			So(ttl, ShouldAlmostEqual, wantAround, float64(time.Second))
+
+			tooLong := getStartOfDay(createdAt).Add(retentionWindow).Sub(time.Now().UTC())
+			So(ttl, ShouldBeLessThan, tooLong)
+		})
+
+		Convey("a post created yesterday should already be close to expiry", func() {
+			ttl := sevenDayKeyTTL(getXDaysAgo(time.Now().UTC(), 1))
+
+			So(ttl, ShouldBeLessThan, sevenDayRetentionWindow)
+		})
+	})
+}